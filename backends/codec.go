@@ -0,0 +1,292 @@
+package backends
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+/*
+Entry序列化的版本前缀，置于编码结果的第一个字节
+节点可以据此在滚动升级过程中识别并解码由旧codec写入的entry，而不会因codec变更中断集群
+*/
+const (
+	codecVersionJSON      byte = 0x01
+	codecVersionProtobuf  byte = 0x02
+	codecVersionMsgpack   byte = 0x03
+	defaultCodecName           = "json"
+)
+
+/*
+Codec Entry的序列化/反序列化接口
+不同实现对应不同的线上编码格式，便于与其它服务发现客户端互通(例如使用不同编码的rpcx生态消费者)
+*/
+type Codec interface {
+	Marshal(entry *Entry) ([]byte, error)
+	Unmarshal(buf []byte) (*Entry, error)
+}
+
+var (
+	codecsMutex     sync.RWMutex
+	codecsByName    = map[string]Codec{}
+	codecsByVersion = map[byte]Codec{}
+)
+
+func init() {
+	RegisterCodec(defaultCodecName, codecVersionJSON, &jsonCodec{})
+	RegisterCodec("protobuf", codecVersionProtobuf, &protobufCodec{})
+	RegisterCodec("msgpack", codecVersionMsgpack, &msgpackCodec{})
+}
+
+/*
+RegisterCodec 注册一个具名的Codec实现及其版本前缀字节
+name/version重复注册时后者覆盖前者，便于调用方替换默认实现
+*/
+func RegisterCodec(name string, version byte, codec Codec) {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+	codecsByName[name] = codec
+	codecsByVersion[version] = codec
+}
+
+/*
+GetCodec 根据名称查找已注册的Codec，用于Initialize按kv.codec选择写入时使用的编码
+name为空时返回默认的json codec
+*/
+func GetCodec(name string) (Codec, error) {
+	if name == "" {
+		name = defaultCodecName
+	}
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+	codec, exists := codecsByName[name]
+	if !exists {
+		return nil, fmt.Errorf("kv.codec %q is not registered", name)
+	}
+	return codec, nil
+}
+
+/*
+GetCodecByVersion 根据entry数据第一个字节(版本前缀)查找对应Codec，用于解码时按实际写入方选择，
+而不是盲目套用本节点配置的kv.codec——这样滚动升级期间新旧codec写入的entry都能被正确解码
+*/
+func GetCodecByVersion(version byte) (Codec, error) {
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+	codec, exists := codecsByVersion[version]
+	if !exists {
+		return nil, fmt.Errorf("entry codec version %#x is not registered", version)
+	}
+	return codec, nil
+}
+
+/*
+jsonCodec 默认的json编码实现，行为与历史EnCodeEntry/PressEntriesData保持一致
+*/
+type jsonCodec struct{}
+
+func (c *jsonCodec) Marshal(entry *Entry) ([]byte, error) {
+	buf, err := EnCodeEntry(entry)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{codecVersionJSON}, buf...), nil
+}
+
+func (c *jsonCodec) Unmarshal(buf []byte) (*Entry, error) {
+	entries, err := PressEntriesData([][]byte{stripVersionPrefix(buf)})
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, ErrEntryInvlid
+	}
+	return entries[0], nil
+}
+
+/*
+protobufCodec Entry的protobuf线格式编码实现
+首字节为版本前缀，其后的字节等价于如下.proto定义，手写wire-format以避免引入生成代码依赖：
+
+	message Entry {
+	    string key = 1;
+	    bytes data = 2;
+	}
+*/
+type protobufCodec struct{}
+
+func (c *protobufCodec) Marshal(entry *Entry) ([]byte, error) {
+
+	buf := make([]byte, 0, len(entry.Key)+len(entry.Data)+10)
+	buf = appendProtobufTagLenBytes(buf, 1, []byte(entry.Key))
+	buf = appendProtobufTagLenBytes(buf, 2, entry.Data)
+	return append([]byte{codecVersionProtobuf}, buf...), nil
+}
+
+func (c *protobufCodec) Unmarshal(buf []byte) (*Entry, error) {
+
+	buf = stripVersionPrefix(buf)
+	entry := &Entry{}
+	for len(buf) > 0 {
+		tag, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, ErrEntryInvlid
+		}
+		buf = buf[n:]
+
+		fieldNum := tag >> 3
+		length, n := binary.Uvarint(buf)
+		if n <= 0 || uint64(len(buf)-n) < length {
+			return nil, ErrEntryInvlid
+		}
+		buf = buf[n:]
+		value := buf[:length]
+		buf = buf[length:]
+
+		switch fieldNum {
+		case 1:
+			entry.Key = string(value)
+		case 2:
+			entry.Data = append([]byte{}, value...)
+		}
+	}
+	return entry, nil
+}
+
+/*
+appendProtobufTagLenBytes 写入一个protobuf length-delimited(wiretype=2)字段: tag、varint长度、原始字节
+*/
+func appendProtobufTagLenBytes(buf []byte, fieldNum int, value []byte) []byte {
+	tag := uint64(fieldNum)<<3 | 2
+	buf = appendUvarint(buf, tag)
+	buf = appendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+/*
+msgpackCodec Entry的msgpack线格式编码实现
+按msgpack规范手写fixmap/str/bin编码，去掉首字节版本前缀后，其余字节可被任意标准msgpack解码器解析为
+{"Key": <str>, "Data": <bin>}
+*/
+type msgpackCodec struct{}
+
+func (c *msgpackCodec) Marshal(entry *Entry) ([]byte, error) {
+
+	buf := make([]byte, 0, len(entry.Key)+len(entry.Data)+16)
+	buf = append(buf, 0x82) //fixmap，2个键值对
+	var err error
+	if buf, err = appendMsgpackStr(buf, "Key"); err != nil {
+		return nil, err
+	}
+	if buf, err = appendMsgpackStr(buf, entry.Key); err != nil {
+		return nil, err
+	}
+	if buf, err = appendMsgpackStr(buf, "Data"); err != nil {
+		return nil, err
+	}
+	if buf, err = appendMsgpackBin(buf, entry.Data); err != nil {
+		return nil, err
+	}
+	return append([]byte{codecVersionMsgpack}, buf...), nil
+}
+
+func (c *msgpackCodec) Unmarshal(buf []byte) (*Entry, error) {
+
+	buf = stripVersionPrefix(buf)
+	if len(buf) == 0 || buf[0]&0xf0 != 0x80 {
+		return nil, ErrEntryInvlid
+	}
+	count := int(buf[0] & 0x0f)
+	buf = buf[1:]
+
+	entry := &Entry{}
+	for i := 0; i < count; i++ {
+		key, rest, err := readMsgpackStr(buf)
+		if err != nil {
+			return nil, err
+		}
+		buf = rest
+
+		switch key {
+		case "Key":
+			value, rest, err := readMsgpackStr(buf)
+			if err != nil {
+				return nil, err
+			}
+			entry.Key = value
+			buf = rest
+		case "Data":
+			value, rest, err := readMsgpackBin(buf)
+			if err != nil {
+				return nil, err
+			}
+			entry.Data = value
+			buf = rest
+		default:
+			return nil, ErrEntryInvlid
+		}
+	}
+	return entry, nil
+}
+
+//maxMsgpackLen str16(0xda)/bin16(0xc5)用的2字节大端长度前缀能表示的最大值
+const maxMsgpackLen = 0xffff
+
+func appendMsgpackStr(buf []byte, s string) ([]byte, error) {
+	if len(s) > maxMsgpackLen {
+		return nil, ErrEntryInvlid
+	}
+	buf = append(buf, 0xda, byte(len(s)>>8), byte(len(s)))
+	return append(buf, s...), nil
+}
+
+func appendMsgpackBin(buf []byte, data []byte) ([]byte, error) {
+	if len(data) > maxMsgpackLen {
+		return nil, ErrEntryInvlid
+	}
+	buf = append(buf, 0xc5, byte(len(data)>>8), byte(len(data)))
+	return append(buf, data...), nil
+}
+
+func readMsgpackStr(buf []byte) (string, []byte, error) {
+	if len(buf) < 3 || buf[0] != 0xda {
+		return "", nil, ErrEntryInvlid
+	}
+	length := int(binary.BigEndian.Uint16(buf[1:3]))
+	if len(buf) < 3+length {
+		return "", nil, ErrEntryInvlid
+	}
+	return string(buf[3 : 3+length]), buf[3+length:], nil
+}
+
+func readMsgpackBin(buf []byte) ([]byte, []byte, error) {
+	if len(buf) < 3 || buf[0] != 0xc5 {
+		return nil, nil, ErrEntryInvlid
+	}
+	length := int(binary.BigEndian.Uint16(buf[1:3]))
+	if len(buf) < 3+length {
+		return nil, nil, ErrEntryInvlid
+	}
+	return append([]byte{}, buf[3:3+length]...), buf[3+length:], nil
+}
+
+/*
+stripVersionPrefix 去掉编码结果最前面的版本字节，兼容无前缀的历史数据
+*/
+func stripVersionPrefix(buf []byte) []byte {
+	if len(buf) == 0 {
+		return buf
+	}
+	switch buf[0] {
+	case codecVersionJSON, codecVersionProtobuf, codecVersionMsgpack:
+		return buf[1:]
+	default:
+		return buf
+	}
+}
@@ -0,0 +1,89 @@
+package backends
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+/*
+TestProtobufCodecRoundTrip 验证protobufCodec编码后能被自身正确解码还原
+*/
+func TestProtobufCodecRoundTrip(t *testing.T) {
+
+	codec := &protobufCodec{}
+	entry := &Entry{Key: "node-1", Data: []byte("node-1-data")}
+
+	buf, err := codec.Marshal(entry)
+	if err != nil {
+		t.Fatalf("marshal error:%s", err.Error())
+	}
+	if buf[0] != codecVersionProtobuf {
+		t.Fatalf("expect version prefix %#x, got %#x", codecVersionProtobuf, buf[0])
+	}
+
+	got, err := codec.Unmarshal(buf)
+	if err != nil {
+		t.Fatalf("unmarshal error:%s", err.Error())
+	}
+	if got.Key != entry.Key || !bytes.Equal(got.Data, entry.Data) {
+		t.Fatalf("round trip mismatch: got %+v, want %+v", got, entry)
+	}
+}
+
+/*
+TestMsgpackCodecRoundTrip 验证msgpackCodec编码后能被自身正确解码还原
+*/
+func TestMsgpackCodecRoundTrip(t *testing.T) {
+
+	codec := &msgpackCodec{}
+	entry := &Entry{Key: "node-1", Data: []byte("node-1-data")}
+
+	buf, err := codec.Marshal(entry)
+	if err != nil {
+		t.Fatalf("marshal error:%s", err.Error())
+	}
+	if buf[0] != codecVersionMsgpack {
+		t.Fatalf("expect version prefix %#x, got %#x", codecVersionMsgpack, buf[0])
+	}
+
+	got, err := codec.Unmarshal(buf)
+	if err != nil {
+		t.Fatalf("unmarshal error:%s", err.Error())
+	}
+	if got.Key != entry.Key || !bytes.Equal(got.Data, entry.Data) {
+		t.Fatalf("round trip mismatch: got %+v, want %+v", got, entry)
+	}
+}
+
+/*
+TestMsgpackCodecMarshalBounds 验证超过str16/bin16长度上限(65535字节)的Key/Data会被拒绝编码，
+而不是被appendMsgpackStr/appendMsgpackBin静默截断成一份无法被正确解码的坏数据
+*/
+func TestMsgpackCodecMarshalBounds(t *testing.T) {
+
+	codec := &msgpackCodec{}
+
+	oversizedData := bytes.Repeat([]byte("a"), maxMsgpackLen+1)
+	if _, err := codec.Marshal(&Entry{Key: "node-1", Data: oversizedData}); err == nil {
+		t.Fatalf("expect error marshalling oversized Data, got nil")
+	}
+
+	oversizedKey := strings.Repeat("k", maxMsgpackLen+1)
+	if _, err := codec.Marshal(&Entry{Key: oversizedKey, Data: []byte("node-1-data")}); err == nil {
+		t.Fatalf("expect error marshalling oversized Key, got nil")
+	}
+
+	maxData := bytes.Repeat([]byte("a"), maxMsgpackLen)
+	buf, err := codec.Marshal(&Entry{Key: "node-1", Data: maxData})
+	if err != nil {
+		t.Fatalf("marshal at max length error:%s", err.Error())
+	}
+	got, err := codec.Unmarshal(buf)
+	if err != nil {
+		t.Fatalf("unmarshal at max length error:%s", err.Error())
+	}
+	if !bytes.Equal(got.Data, maxData) {
+		t.Fatalf("round trip at max length mismatch")
+	}
+}
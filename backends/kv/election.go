@@ -0,0 +1,129 @@
+package kv
+
+import (
+	"log"
+	"path"
+	"time"
+
+	"github.com/abronan/valkeyrie/store"
+)
+
+/*
+LeaderEvent 领导者选举状态变化事件
+IsLeader为true时LeaderID即为当前candidateID，否则为观察到的新leader
+*/
+type LeaderEvent struct {
+	IsLeader bool
+	LeaderID string
+}
+
+/*
+Elect 基于d.store实现的分布式leader选举
+参照libkv生态中swarm/leadership的做法：用AtomicPut抢占d.nspath+"/leader/"+key下的TTL key，
+AtomicDelete清场释放，Watch观察该key的状态变化
+key: 选举域标识
+candidateID: 当前候选者唯一编码
+stopCh: 退出选举
+*/
+func (d *Discovery) Elect(key string, candidateID string, stopCh <-chan struct{}) (<-chan LeaderEvent, <-chan error) {
+
+	leaderKey := path.Join(d.nspath, "leader", key)
+	eventCh := make(chan LeaderEvent)
+	errCh := make(chan error)
+
+	go func() {
+		defer close(eventCh)
+		defer close(errCh)
+
+		var (
+			isLeader    bool
+			leaderID    string
+			lastKVPair  *store.KVPair
+			renewTicker = time.NewTicker(d.ttl / 3)
+		)
+		defer renewTicker.Stop()
+
+		campaign := func() {
+			success, pair, err := d.store.AtomicPut(leaderKey, []byte(candidateID), lastKVPair, &store.WriteOptions{TTL: d.ttl})
+			if err != nil {
+				if err == store.ErrKeyModified || err == store.ErrKeyNotFound {
+					//被其它candidate抢先或key被意外清除，下一轮重新读取后重试
+					lastKVPair = nil
+					return
+				}
+				errCh <- err
+				return
+			}
+			lastKVPair = pair
+			if !success {
+				return
+			}
+			if !isLeader {
+				isLeader = true
+				leaderID = candidateID
+				eventCh <- LeaderEvent{IsLeader: true, LeaderID: candidateID}
+			}
+		}
+
+		release := func() {
+			if isLeader && lastKVPair != nil {
+				d.store.AtomicDelete(leaderKey, lastKVPair)
+			}
+		}
+
+		campaign()
+		for {
+			watchCh, err := d.store.Watch(leaderKey, stopCh, nil)
+			if err != nil {
+				errCh <- err
+				time.Sleep(time.Second * 5)
+				continue
+			}
+
+			//watch刚建立或重建后，无论当前是否持有leader身份都重新抢占一次：
+			//leader断线重连期间key可能已被清除或被其它candidate持有，standby必须借此机会重试AtomicPut，
+			//否则只有isLeader的一方会在renewTicker中续期，standby永远等不到下一次成为leader的机会
+			campaign()
+
+			reconnect := false
+			for !reconnect {
+				select {
+				case <-stopCh:
+					release()
+					return
+
+				case <-renewTicker.C:
+					if isLeader {
+						campaign()
+					}
+
+				case pair := <-watchCh:
+					if pair == nil {
+						//watch通道被关闭或异常中断，不代表key真的被删除，重新建立watch后再判断归属
+						reconnect = true
+						continue
+					}
+					if string(pair.Value) != candidateID {
+						//观察到其它candidate持有该key，说明自己已丢失leader身份
+						wasLeader := isLeader
+						if isLeader {
+							isLeader = false
+							log.Printf("discovery election(%s) lost leadership to %s\n", key, string(pair.Value))
+						}
+						lastKVPair = pair
+						//其它leader续期同样会触发watch，仅在leader身份实际变化时才推送事件
+						if wasLeader || leaderID != string(pair.Value) {
+							leaderID = string(pair.Value)
+							eventCh <- LeaderEvent{IsLeader: false, LeaderID: leaderID}
+						}
+					} else {
+						lastKVPair = pair
+					}
+				}
+			}
+			time.Sleep(time.Second * 5)
+		}
+	}()
+
+	return eventCh, errCh
+}
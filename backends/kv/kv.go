@@ -1,16 +1,21 @@
 package kv
 
 import "github.com/docker/go-connections/tlsconfig"
-import "github.com/docker/libkv"
-import "github.com/docker/libkv/store"
-import "github.com/docker/libkv/store/consul"
-import "github.com/docker/libkv/store/etcd"
-import "github.com/docker/libkv/store/zookeeper"
+import "github.com/abronan/valkeyrie"
+import "github.com/abronan/valkeyrie/store"
+import "github.com/abronan/valkeyrie/store/boltdb"
+import "github.com/abronan/valkeyrie/store/consul"
+import etcd "github.com/abronan/valkeyrie/store/etcd/v3"
+import "github.com/abronan/valkeyrie/store/redis"
+import "github.com/abronan/valkeyrie/store/zookeeper"
 import "github.com/humpback/discovery/backends"
 
 import (
+	"crypto/tls"
 	"log"
 	"path"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -19,9 +24,11 @@ import (
 /*
 构建时若不指定configopts情况
 发现默认路径为defaultDiscoveryPath值
+watchDebounce为watch事件合并窗口默认值
 */
 const (
 	defaultDiscoveryPath = "discovery/service"
+	defaultWatchDebounce = 100 * time.Millisecond
 )
 
 /*
@@ -30,34 +37,58 @@ Discovery 发现服务结构定义
 */
 type Discovery struct {
 	sync.Mutex
-	backend   store.Backend
-	store     store.Store
-	heartbeat time.Duration
-	ttl       time.Duration
-	prefix    string
-	nspath    string
+	backend          store.Backend
+	store            store.Store
+	heartbeat        time.Duration
+	ttl              time.Duration
+	prefix           string
+	nspath           string
+	codec            backends.Codec
+	watchConcurrency int
+	watchDebounce    time.Duration
+	metrics          backends.Metrics
+
+	//独立于d.store持有的原生客户端，仅用于RegisterWithSession的session/lease能力，
+	//因为valkeyrie对应Store实现均未导出底层客户端，无法通过d.store断言取得
+	//具体类型(*consulapi.Client/*etcdv3.Client/*zk.Conn)由对应backend的build tag(consul/etcd/zk)决定，
+	//未开启对应tag时RegisterWithSession自动回退到心跳Register，不要求调用方关心此处的底层类型
+	nativeClient interface{}
 }
 
 /*
-init 初始化libkv包并构建Discovery实例
-只实现了zookeeper,consul与etcd三种方式
+SetMetrics 设置Prometheus等可观测性钩子
+未设置时默认使用backends.NoopMetrics，调用方应在Initialize之前或之后均可调用
+*/
+func (d *Discovery) SetMetrics(metrics backends.Metrics) {
+	d.Lock()
+	defer d.Unlock()
+	d.metrics = metrics
+}
+
+/*
+init 初始化valkeyrie包并构建Discovery实例
+实现了zookeeper,consul,etcd,boltdb与redis五种方式
 */
 func init() {
 
-	//注册默认支持libkv库
+	//注册默认支持valkeyrie库
 	zookeeper.Register()
 	consul.Register()
 	etcd.Register()
+	boltdb.Register()
+	redis.Register()
 
 	//注册backend
 	backends.Register("zk", &Discovery{backend: store.ZK})
 	backends.Register("consul", &Discovery{backend: store.CONSUL})
-	backends.Register("etcd", &Discovery{backend: store.ETCD})
+	backends.Register("etcd", &Discovery{backend: store.ETCDV3})
+	backends.Register("boltdb", &Discovery{backend: store.BOLTDB})
+	backends.Register("redis", &Discovery{backend: store.REDIS})
 }
 
 /*
 Initialize 初始化一个Discovery实例
-根据backend类型构造出libkv的Store
+根据backend类型构造出valkeyrie的Store
 */
 func (d *Discovery) Initialize(uris string, heartbeat time.Duration, ttl time.Duration, configopts map[string]string) error {
 
@@ -102,9 +133,82 @@ func (d *Discovery) Initialize(uris string, heartbeat time.Duration, ttl time.Du
 		log.Printf("Initializing discovery without TLS...\n")
 	}
 
+	if d.backend == store.BOLTDB || d.backend == store.REDIS {
+		if config == nil {
+			config = &store.Config{}
+		}
+		if configopts["kv.bucket"] != "" {
+			config.Bucket = strings.TrimSpace(configopts["kv.bucket"])
+		}
+		if configopts["kv.persist_connection"] != "" {
+			config.PersistConnection = strings.TrimSpace(configopts["kv.persist_connection"]) == "true"
+		}
+		if configopts["kv.connection_timeout"] != "" {
+			if timeout, err := time.ParseDuration(strings.TrimSpace(configopts["kv.connection_timeout"])); err == nil {
+				config.ConnectionTimeout = timeout
+			}
+		}
+		if configopts["kv.password"] != "" {
+			config.Password = strings.TrimSpace(configopts["kv.password"])
+		}
+	}
+
+	//BoltDB是内嵌存储，addrs只允许单节点(本地文件路径)
+	//文件路径本身含"/"，因此整个uris(第一个逗号之前的部分)即为地址，不从中切分prefix
+	if d.backend == store.BOLTDB {
+		addrs = strings.Split(uris, ",")[:1]
+		d.prefix = ""
+	}
+
+	d.codec, err = backends.GetCodec(configopts["kv.codec"])
+	if err != nil {
+		return err
+	}
+
+	d.watchDebounce = defaultWatchDebounce
+	if configopts["kv.watch_debounce"] != "" {
+		if debounce, err := time.ParseDuration(strings.TrimSpace(configopts["kv.watch_debounce"])); err == nil {
+			d.watchDebounce = debounce
+		}
+	}
+
+	d.watchConcurrency = runtime.NumCPU() * 2
+	if configopts["kv.watch_concurrency"] != "" {
+		if concurrency, err := strconv.Atoi(strings.TrimSpace(configopts["kv.watch_concurrency"])); err == nil && concurrency > 0 {
+			d.watchConcurrency = concurrency
+		}
+	}
+
+	if d.metrics == nil {
+		d.metrics = backends.NoopMetrics{}
+	}
+
 	d.nspath = path.Join(d.prefix, dpath, "nodes")
-	d.store, err = libkv.NewStore(d.backend, addrs, config)
-	return err
+	d.store, err = valkeyrie.NewStore(d.backend, addrs, config)
+	if err != nil {
+		return err
+	}
+
+	//RegisterWithSession依赖各后端的原生客户端才能使用session/lease，
+	//这里是可选增强：建连失败只记录日志，RegisterWithSession会自动回退到心跳Register
+	var sessionErr error
+	switch d.backend {
+	case store.CONSUL:
+		sessionErr = d.initConsulSessionClient(addrs, configopts)
+	case store.ETCDV3:
+		var tlsConfig *tls.Config
+		if config != nil {
+			tlsConfig = config.TLS
+		}
+		sessionErr = d.initEtcdSessionClient(addrs, tlsConfig)
+	case store.ZK:
+		sessionErr = d.initZkSessionClient(addrs)
+	}
+	if sessionErr != nil {
+		log.Printf("discovery init native session client error:%s\n", sessionErr.Error())
+	}
+
+	return nil
 }
 
 /*
@@ -126,7 +230,7 @@ func (d *Discovery) Register(key string, data []byte, stopCh <-chan struct{}) <-
 
 		opts := &store.WriteOptions{TTL: d.ttl}
 		entry := &backends.Entry{Key: key, Data: data}
-		buf, err := backends.EnCodeEntry(entry)
+		buf, err := d.codec.Marshal(entry)
 		if err != nil {
 			errCh <- backends.ErrEntryInvlid
 			return
@@ -139,6 +243,7 @@ func (d *Discovery) Register(key string, data []byte, stopCh <-chan struct{}) <-
 				{
 					t.Stop()
 					if err := d.store.Put(path.Join(d.nspath, key), buf, opts); err != nil {
+						d.metrics.IncRegisterFailures()
 						errCh <- err
 					}
 				}
@@ -167,7 +272,7 @@ func (d *Discovery) WatchNodes(stopCh <-chan struct{}) (<-chan backends.Entries,
 		defer close(ch)
 		defer close(errCh)
 		for {
-			exists, err := d.store.Exists(d.nspath)
+			exists, err := d.store.Exists(d.nspath, nil)
 			if err != nil {
 				errCh <- err
 			}
@@ -176,7 +281,7 @@ func (d *Discovery) WatchNodes(stopCh <-chan struct{}) (<-chan backends.Entries,
 					errCh <- err
 				}
 			}
-			watchCh, err := d.store.WatchTree(d.nspath, stopCh)
+			watchCh, err := d.store.WatchTree(d.nspath, stopCh, nil)
 			if err != nil {
 				errCh <- err
 			} else {
@@ -206,7 +311,7 @@ func (d *Discovery) WatchExtend(key string, stopCh <-chan struct{}) (<-chan []by
 		defer close(dataCh)
 		defer close(errCh)
 		for {
-			watchCh, err := d.store.Watch(key, stopCh)
+			watchCh, err := d.store.Watch(key, stopCh, nil)
 			if err != nil {
 				errCh <- err
 			} else {
@@ -231,29 +336,56 @@ func (d *Discovery) WatchExtend(key string, stopCh <-chan struct{}) (<-chan []by
 	return dataCh, errCh
 }
 
+/*
+watchOnce 聚合一轮WatchTree事件直到stopCh关闭或上游watchCh关闭
+为避免churny集群频繁触发discoveryCh，在d.watchDebounce窗口内到达的多批pairs会按key合并为一批再下推
+*/
 func (d *Discovery) watchOnce(stopCh <-chan struct{}, watchCh <-chan []*store.KVPair, discoveryCh chan backends.Entries, errCh chan error) bool {
 
+	pending := map[string]*store.KVPair{}
+	var debounceCh <-chan time.Time
+
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		pairs := make([]*store.KVPair, 0, len(pending))
+		for _, pair := range pending {
+			pairs = append(pairs, pair)
+		}
+		pending = map[string]*store.KVPair{}
+
+		data := d.pullKVPairsData(pairs)
+		entries, err := d.decodeEntriesData(data)
+		if err != nil {
+			errCh <- err
+		} else {
+			discoveryCh <- entries
+		}
+	}
+
 	for {
 		select {
 		case pairs := <-watchCh:
 			{
 				if pairs == nil {
+					flush()
 					return true
 				}
 
-				//data := d.pullKVPairsData(pairs)
-				data := make([][]byte, len(pairs))
+				d.metrics.IncWatchEvents()
 				for _, pair := range pairs {
-					data = append(data, pair.Value)
+					pending[pair.Key] = pair
 				}
-
-				entries, err := backends.PressEntriesData(data)
-				if err != nil {
-					errCh <- err
-				} else {
-					discoveryCh <- entries
+				if debounceCh == nil {
+					debounceCh = time.After(d.watchDebounce)
 				}
 			}
+		case <-debounceCh:
+			{
+				flush()
+				debounceCh = nil
+			}
 		case <-stopCh:
 			{
 				return false
@@ -262,35 +394,81 @@ func (d *Discovery) watchOnce(stopCh <-chan struct{}, watchCh <-chan []*store.KV
 	}
 }
 
+/*
+decodeEntriesData 将watch收到的原始数据逐条解码为Entries
+优先按每条数据自带的版本前缀字节挑选对应Codec解码，使滚动升级期间新旧codec写入的entry都能
+被正确识别；版本前缀未注册(如升级前写入的无前缀历史数据)时回退到d.codec解码
+跳过无法解码的空/脏数据项，而不是让整批watch事件失败
+*/
+func (d *Discovery) decodeEntriesData(data [][]byte) (backends.Entries, error) {
+
+	entries := make(backends.Entries, 0, len(data))
+	for _, buf := range data {
+		if len(buf) == 0 {
+			continue
+		}
+
+		codec := d.codec
+		if versioned, err := backends.GetCodecByVersion(buf[0]); err == nil {
+			codec = versioned
+		}
+
+		entry, err := codec.Unmarshal(buf)
+		if err != nil {
+			log.Printf("discovery decode entry error:%s\n", err.Error())
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+/*
+pullKVPairsData 收集每个pair的原始数据
+WatchTree事件本身携带的Value已足够时直接使用，仅当某个pair缺失Value(依赖具体后端实现)时才回源Get，
+回源使用d.watchConcurrency控制的有界worker池，避免大集群下每次watch都启动无限goroutine
+*/
 func (d *Discovery) pullKVPairsData(pairs []*store.KVPair) [][]byte {
 
-	d.Lock()
-	defer d.Unlock()
+	data := make([][]byte, 0, len(pairs))
+	needGet := make([]*store.KVPair, 0)
+	for _, pair := range pairs {
+		if len(pair.Value) > 0 {
+			data = append(data, pair.Value)
+		} else {
+			needGet = append(needGet, pair)
+		}
+	}
 
-	pCall := struct {
-		sync.Mutex
-		Data [][]byte
-	}{
-		Data: make([][]byte, 0),
+	if len(needGet) == 0 {
+		return data
 	}
 
-	size := len(pairs)
-	wgroup := sync.WaitGroup{}
-	wgroup.Add(size)
-	for _, it := range pairs {
+	var (
+		mutex  sync.Mutex
+		wgroup sync.WaitGroup
+		sem    = make(chan struct{}, d.watchConcurrency)
+	)
+
+	wgroup.Add(len(needGet))
+	for _, it := range needGet {
+		sem <- struct{}{}
 		go func(p *store.KVPair) {
-			path := path.Join(d.nspath, p.Key)
-			pair, err := d.store.Get(path)
+			defer wgroup.Done()
+			defer func() { <-sem }()
+
+			fullpath := path.Join(d.nspath, p.Key)
+			pair, err := d.store.Get(fullpath, nil)
 			if err != nil {
-				log.Printf("discovery watch error:%s | %s\n", path, err.Error())
-			} else {
-				pCall.Lock()
-				pCall.Data = append(pCall.Data, pair.Value)
-				pCall.Unlock()
+				d.metrics.IncWatchErrors()
+				log.Printf("discovery watch error:%s | %s\n", fullpath, err.Error())
+				return
 			}
-			wgroup.Done()
+			mutex.Lock()
+			data = append(data, pair.Value)
+			mutex.Unlock()
 		}(it)
 	}
 	wgroup.Wait()
-	return pCall.Data
+	return data
 }
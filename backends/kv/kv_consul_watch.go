@@ -0,0 +1,381 @@
+// +build consul
+
+package kv
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/abronan/valkeyrie/store"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+/*
+ConsulWatcher 基于hashicorp/consul/api提供的富监视能力
+仅在d.backend == store.CONSUL时可用，上层抽象backends接口保持不变
+*/
+type ConsulWatcher struct {
+	sync.Mutex
+	client      *consulapi.Client
+	stopCh      <-chan struct{}
+	onService   func(name string, entries []*consulapi.ServiceEntry)
+	onServices  func(services map[string][]string)
+	onCheck     func(checks consulapi.HealthChecks)
+	onEvent     func(events []*consulapi.UserEvent)
+	onKeyPrefix func(pairs consulapi.KVPairs)
+	onNodes     func(nodes []*consulapi.Node)
+	handler     WatchHandler
+}
+
+/*
+WatchHandler watch触发时的外部处理器
+可配置为执行外部命令或调用HTTP端点，类比consul自身的watch handler机制
+*/
+type WatchHandler interface {
+	Handle(watchType string, data interface{})
+}
+
+/*
+ConsulWatcher 根据d.backend构造一个ConsulWatcher
+仅当底层使用CONSUL后端时返回非nil实例
+*/
+func (d *Discovery) ConsulWatcher(stopCh <-chan struct{}, handler WatchHandler) (*ConsulWatcher, error) {
+
+	if d.backend != store.CONSUL {
+		return nil, fmt.Errorf("ConsulWatcher only supported with CONSUL backend")
+	}
+
+	consulClient, ok := d.nativeClient.(*consulapi.Client)
+	if !ok || consulClient == nil {
+		return nil, fmt.Errorf("ConsulWatcher requires an initialized consul session client")
+	}
+
+	return &ConsulWatcher{
+		client:  consulClient,
+		stopCh:  stopCh,
+		handler: handler,
+	}, nil
+}
+
+/*
+OnServiceChange 订阅指定服务名的services变化
+fn在每次阻塞查询返回新index时被调用
+*/
+func (w *ConsulWatcher) OnServiceChange(name string, fn func(entries []*consulapi.ServiceEntry)) {
+
+	w.Lock()
+	w.onService = func(_ string, entries []*consulapi.ServiceEntry) { fn(entries) }
+	w.Unlock()
+	go w.superviseService(name)
+}
+
+/*
+OnServicesChange 订阅catalog级别的服务列表变化(services)
+与OnServiceChange不同，这里监视的是全部服务名及其tag，而非单个服务的实例列表
+*/
+func (w *ConsulWatcher) OnServicesChange(fn func(services map[string][]string)) {
+
+	w.Lock()
+	w.onServices = fn
+	w.Unlock()
+	go w.superviseServices()
+}
+
+/*
+OnCheckChange 订阅checks变化
+*/
+func (w *ConsulWatcher) OnCheckChange(fn func(checks consulapi.HealthChecks)) {
+
+	w.Lock()
+	w.onCheck = fn
+	w.Unlock()
+	go w.superviseChecks()
+}
+
+/*
+OnEvent 订阅用户自定义event
+*/
+func (w *ConsulWatcher) OnEvent(name string, fn func(events []*consulapi.UserEvent)) {
+
+	w.Lock()
+	w.onEvent = fn
+	w.Unlock()
+	go w.superviseEvent(name)
+}
+
+/*
+OnKeyPrefixChange 订阅keyprefix变化
+*/
+func (w *ConsulWatcher) OnKeyPrefixChange(prefix string, fn func(pairs consulapi.KVPairs)) {
+
+	w.Lock()
+	w.onKeyPrefix = fn
+	w.Unlock()
+	go w.superviseKeyPrefix(prefix)
+}
+
+/*
+OnNodesChange 订阅catalog级别的节点列表变化(nodes)
+*/
+func (w *ConsulWatcher) OnNodesChange(fn func(nodes []*consulapi.Node)) {
+
+	w.Lock()
+	w.onNodes = fn
+	w.Unlock()
+	go w.superviseNodes()
+}
+
+/*
+superviseKeyPrefix 监视keyprefix变化
+*/
+func (w *ConsulWatcher) superviseKeyPrefix(prefix string) {
+
+	var lastIndex uint64
+	backoff := time.Second
+	for {
+		select {
+		case <-w.stopCh:
+			return
+		default:
+		}
+
+		pairs, meta, err := w.client.KV().List(prefix, &consulapi.QueryOptions{
+			WaitIndex: lastIndex,
+			WaitTime:  time.Minute,
+		})
+		if err != nil {
+			log.Printf("discovery consul watch keyprefix(%s) error:%s\n", prefix, err.Error())
+			time.Sleep(backoff)
+			if backoff < time.Minute {
+				backoff = backoff * 2
+			}
+			continue
+		}
+
+		backoff = time.Second
+		if meta.LastIndex == lastIndex {
+			continue
+		}
+		lastIndex = meta.LastIndex
+
+		if w.onKeyPrefix != nil {
+			w.onKeyPrefix(pairs)
+		}
+		if w.handler != nil {
+			w.handler.Handle("keyprefix", pairs)
+		}
+	}
+}
+
+/*
+superviseService 对services阻塞查询结果去重并重连
+lastIndex用consul的blocking-query index去重，失败时退避重试
+*/
+func (w *ConsulWatcher) superviseService(name string) {
+
+	var lastIndex uint64
+	backoff := time.Second
+	for {
+		select {
+		case <-w.stopCh:
+			return
+		default:
+		}
+
+		entries, meta, err := w.client.Health().Service(name, "", false, &consulapi.QueryOptions{
+			WaitIndex: lastIndex,
+			WaitTime:  time.Minute,
+		})
+		if err != nil {
+			log.Printf("discovery consul watch services(%s) error:%s\n", name, err.Error())
+			time.Sleep(backoff)
+			if backoff < time.Minute {
+				backoff = backoff * 2
+			}
+			continue
+		}
+
+		backoff = time.Second
+		if meta.LastIndex == lastIndex {
+			continue
+		}
+		lastIndex = meta.LastIndex
+
+		if w.onService != nil {
+			w.onService(name, entries)
+		}
+		if w.handler != nil {
+			w.handler.Handle("service", entries)
+		}
+	}
+}
+
+/*
+superviseServices 监视catalog级别的服务列表(服务名->tags)变化
+*/
+func (w *ConsulWatcher) superviseServices() {
+
+	var lastIndex uint64
+	backoff := time.Second
+	for {
+		select {
+		case <-w.stopCh:
+			return
+		default:
+		}
+
+		services, meta, err := w.client.Catalog().Services(&consulapi.QueryOptions{
+			WaitIndex: lastIndex,
+			WaitTime:  time.Minute,
+		})
+		if err != nil {
+			log.Printf("discovery consul watch services error:%s\n", err.Error())
+			time.Sleep(backoff)
+			if backoff < time.Minute {
+				backoff = backoff * 2
+			}
+			continue
+		}
+
+		backoff = time.Second
+		if meta.LastIndex == lastIndex {
+			continue
+		}
+		lastIndex = meta.LastIndex
+
+		if w.onServices != nil {
+			w.onServices(services)
+		}
+		if w.handler != nil {
+			w.handler.Handle("services", services)
+		}
+	}
+}
+
+/*
+superviseNodes 监视catalog级别的节点列表变化
+*/
+func (w *ConsulWatcher) superviseNodes() {
+
+	var lastIndex uint64
+	backoff := time.Second
+	for {
+		select {
+		case <-w.stopCh:
+			return
+		default:
+		}
+
+		nodes, meta, err := w.client.Catalog().Nodes(&consulapi.QueryOptions{
+			WaitIndex: lastIndex,
+			WaitTime:  time.Minute,
+		})
+		if err != nil {
+			log.Printf("discovery consul watch nodes error:%s\n", err.Error())
+			time.Sleep(backoff)
+			if backoff < time.Minute {
+				backoff = backoff * 2
+			}
+			continue
+		}
+
+		backoff = time.Second
+		if meta.LastIndex == lastIndex {
+			continue
+		}
+		lastIndex = meta.LastIndex
+
+		if w.onNodes != nil {
+			w.onNodes(nodes)
+		}
+		if w.handler != nil {
+			w.handler.Handle("nodes", nodes)
+		}
+	}
+}
+
+/*
+superviseChecks 监视全部健康检查状态变化
+*/
+func (w *ConsulWatcher) superviseChecks() {
+
+	var lastIndex uint64
+	backoff := time.Second
+	for {
+		select {
+		case <-w.stopCh:
+			return
+		default:
+		}
+
+		checks, meta, err := w.client.Health().State("any", &consulapi.QueryOptions{
+			WaitIndex: lastIndex,
+			WaitTime:  time.Minute,
+		})
+		if err != nil {
+			log.Printf("discovery consul watch checks error:%s\n", err.Error())
+			time.Sleep(backoff)
+			if backoff < time.Minute {
+				backoff = backoff * 2
+			}
+			continue
+		}
+
+		backoff = time.Second
+		if meta.LastIndex == lastIndex {
+			continue
+		}
+		lastIndex = meta.LastIndex
+
+		if w.onCheck != nil {
+			w.onCheck(checks)
+		}
+		if w.handler != nil {
+			w.handler.Handle("checks", checks)
+		}
+	}
+}
+
+/*
+superviseEvent 监视用户自定义event
+*/
+func (w *ConsulWatcher) superviseEvent(name string) {
+
+	var lastIndex uint64
+	backoff := time.Second
+	for {
+		select {
+		case <-w.stopCh:
+			return
+		default:
+		}
+
+		events, meta, err := w.client.Event().List(name, &consulapi.QueryOptions{
+			WaitIndex: lastIndex,
+			WaitTime:  time.Minute,
+		})
+		if err != nil {
+			log.Printf("discovery consul watch event(%s) error:%s\n", name, err.Error())
+			time.Sleep(backoff)
+			if backoff < time.Minute {
+				backoff = backoff * 2
+			}
+			continue
+		}
+
+		backoff = time.Second
+		if meta.LastIndex == lastIndex {
+			continue
+		}
+		lastIndex = meta.LastIndex
+
+		if w.onEvent != nil {
+			w.onEvent(events)
+		}
+		if w.handler != nil {
+			w.handler.Handle("event", events)
+		}
+	}
+}
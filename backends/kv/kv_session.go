@@ -0,0 +1,57 @@
+package kv
+
+import (
+	"log"
+	"path"
+
+	"github.com/abronan/valkeyrie/store"
+	"github.com/humpback/discovery/backends"
+)
+
+/*
+RegisterWithSession 基于各后端原生session/lease机制的服务注册
+相比Register的轮询心跳方式，errCh只在真实失效(会话丢失、连接断开)时才会收到数据，
+而不是每个心跳周期都推送
+若当前后端的原生session/lease客户端未就绪(建连失败或后端不支持)，自动回退到Register的轮询路径
+key: 集群节点唯一编码
+data: 节点数据，可为nil
+stopCh: 退出注册
+*/
+func (d *Discovery) RegisterWithSession(key string, data []byte, stopCh <-chan struct{}) <-chan error {
+
+	if key == "" {
+		errCh := make(chan error, 1)
+		errCh <- backends.ErrEntryKeyInvalid
+		close(errCh)
+		return errCh
+	}
+
+	entry := &backends.Entry{Key: key, Data: data}
+	buf, err := d.codec.Marshal(entry)
+	if err != nil {
+		errCh := make(chan error, 1)
+		errCh <- backends.ErrEntryInvlid
+		close(errCh)
+		return errCh
+	}
+
+	fullKey := path.Join(d.nspath, key)
+	var (
+		errCh  <-chan error
+		native bool
+	)
+	switch d.backend {
+	case store.CONSUL:
+		errCh, native = d.registerWithConsulSession(fullKey, buf, stopCh)
+	case store.ETCDV3:
+		errCh, native = d.registerWithEtcdSession(fullKey, buf, stopCh)
+	case store.ZK:
+		errCh, native = d.registerWithZkSession(fullKey, buf, stopCh)
+	}
+	if native {
+		return errCh
+	}
+
+	log.Printf("discovery backend %v does not expose session/lease, falling back to heartbeat Register\n", d.backend)
+	return d.Register(key, data, stopCh)
+}
@@ -0,0 +1,86 @@
+// +build consul
+
+package kv
+
+import (
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+/*
+initConsulSessionClient 直接构造一个*consulapi.Client，与d.store并列持有
+valkeyrie的*consul.Consul不导出其底层client字段，没有办法从d.store断言取出，
+所以这里绕开d.store，独立用相同的地址/TLS配置建一条consul api连接专供session/lease使用
+*/
+func (d *Discovery) initConsulSessionClient(addrs []string, configopts map[string]string) error {
+
+	cfg := consulapi.DefaultConfig()
+	if len(addrs) > 0 {
+		cfg.Address = addrs[0]
+	}
+	if configopts["kv.cacertfile"] != "" && configopts["kv.certfile"] != "" && configopts["kv.keyfile"] != "" {
+		cfg.Scheme = "https"
+		cfg.TLSConfig = consulapi.TLSConfig{
+			CAFile:   configopts["kv.cacertfile"],
+			CertFile: configopts["kv.certfile"],
+			KeyFile:  configopts["kv.keyfile"],
+		}
+	}
+
+	client, err := consulapi.NewClient(cfg)
+	if err != nil {
+		return err
+	}
+	d.nativeClient = client
+	return nil
+}
+
+/*
+registerWithConsulSession 针对CONSUL后端的session适配
+用d.nativeClient创建一个session并用session.RenewPeriodic续约，
+Put时附带session id，session失效(续约goroutine返回)即代表节点下线
+*/
+func (d *Discovery) registerWithConsulSession(key string, buf []byte, stopCh <-chan struct{}) (<-chan error, bool) {
+
+	consulClient, ok := d.nativeClient.(*consulapi.Client)
+	if !ok || consulClient == nil {
+		return nil, false
+	}
+
+	errCh := make(chan error)
+	go func() {
+		defer close(errCh)
+
+		sessionEntry := &consulapi.SessionEntry{
+			Name:     key,
+			TTL:      d.ttl.String(),
+			Behavior: consulapi.SessionBehaviorDelete,
+		}
+		sessionID, _, err := consulClient.Session().Create(sessionEntry, nil)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer consulClient.Session().Destroy(sessionID, nil)
+
+		pair := &consulapi.KVPair{Key: key, Value: buf, Session: sessionID}
+		if _, _, err := consulClient.KV().Acquire(pair, nil); err != nil {
+			errCh <- err
+			return
+		}
+
+		doneCh := make(chan struct{})
+		renewErrCh := make(chan error, 1)
+		go func() {
+			renewErrCh <- consulClient.Session().RenewPeriodic(d.ttl.String(), sessionID, nil, doneCh)
+		}()
+
+		select {
+		case <-stopCh:
+			close(doneCh)
+			consulClient.KV().Delete(key, nil)
+		case err := <-renewErrCh:
+			errCh <- err
+		}
+	}()
+	return errCh, true
+}
@@ -0,0 +1,18 @@
+// +build !consul
+
+package kv
+
+/*
+本文件是consul原生session/lease客户端在未启用consul build tag时的占位实现，
+避免kv.go/kv_session.go无条件引入github.com/hashicorp/consul/api这一较重的依赖。
+initConsulSessionClient直接返回nil(不报错，视为该增强能力未启用)，
+registerWithConsulSession返回(nil, false)使RegisterWithSession自动回退到心跳Register
+*/
+
+func (d *Discovery) initConsulSessionClient(addrs []string, configopts map[string]string) error {
+	return nil
+}
+
+func (d *Discovery) registerWithConsulSession(key string, buf []byte, stopCh <-chan struct{}) (<-chan error, bool) {
+	return nil, false
+}
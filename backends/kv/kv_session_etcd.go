@@ -0,0 +1,80 @@
+// +build etcd
+
+package kv
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+
+	"github.com/humpback/discovery/backends"
+	etcdv3 "go.etcd.io/etcd/client/v3"
+)
+
+/*
+initEtcdSessionClient 直接构造一个*etcdv3.Client，与d.store并列持有
+valkeyrie的*etcdv3.EtcdV3不导出其底层client字段，没有办法从d.store断言取出，
+所以这里绕开d.store，独立用相同的endpoints/TLS配置建一条etcd v3连接专供lease使用
+*/
+func (d *Discovery) initEtcdSessionClient(addrs []string, tlsConfig *tls.Config) error {
+
+	client, err := etcdv3.New(etcdv3.Config{
+		Endpoints:   addrs,
+		DialTimeout: 5 * time.Second,
+		TLS:         tlsConfig,
+	})
+	if err != nil {
+		return err
+	}
+	d.nativeClient = client
+	return nil
+}
+
+/*
+registerWithEtcdSession 针对ETCD后端的lease适配
+用d.nativeClient创建一个lease并用KeepAlive续约，续约channel关闭或收到错误即代表lease失效
+*/
+func (d *Discovery) registerWithEtcdSession(key string, buf []byte, stopCh <-chan struct{}) (<-chan error, bool) {
+
+	etcdClient, ok := d.nativeClient.(*etcdv3.Client)
+	if !ok || etcdClient == nil {
+		return nil, false
+	}
+
+	errCh := make(chan error)
+	go func() {
+		defer close(errCh)
+
+		ctx := context.Background()
+		lease, err := etcdClient.Grant(ctx, int64(d.ttl.Seconds()))
+		if err != nil {
+			errCh <- err
+			return
+		}
+
+		if _, err := etcdClient.Put(ctx, key, string(buf), etcdv3.WithLease(lease.ID)); err != nil {
+			errCh <- err
+			return
+		}
+
+		keepAliveCh, err := etcdClient.KeepAlive(ctx, lease.ID)
+		if err != nil {
+			errCh <- err
+			return
+		}
+
+		for {
+			select {
+			case <-stopCh:
+				etcdClient.Revoke(ctx, lease.ID)
+				return
+			case _, ok := <-keepAliveCh:
+				if !ok {
+					errCh <- backends.ErrRegistLoopQuit
+					return
+				}
+			}
+		}
+	}()
+	return errCh, true
+}
@@ -0,0 +1,20 @@
+// +build !etcd
+
+package kv
+
+import "crypto/tls"
+
+/*
+本文件是etcd原生lease客户端在未启用etcd build tag时的占位实现，
+避免kv.go/kv_session.go无条件引入go.etcd.io/etcd/client/v3这一较重的依赖。
+initEtcdSessionClient直接返回nil(不报错，视为该增强能力未启用)，
+registerWithEtcdSession返回(nil, false)使RegisterWithSession自动回退到心跳Register
+*/
+
+func (d *Discovery) initEtcdSessionClient(addrs []string, tlsConfig *tls.Config) error {
+	return nil
+}
+
+func (d *Discovery) registerWithEtcdSession(key string, buf []byte, stopCh <-chan struct{}) (<-chan error, bool) {
+	return nil, false
+}
@@ -0,0 +1,90 @@
+// +build zk
+
+package kv
+
+import (
+	"log"
+	"path"
+	"time"
+
+	"github.com/abronan/valkeyrie/store"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+/*
+initZkSessionClient 直接构造一个*zk.Conn，与d.store并列持有
+valkeyrie的*zookeeper.Zookeeper不导出其底层conn字段，没有办法从d.store断言取出，
+所以这里绕开d.store，独立建一条zk连接专供ephemeral节点使用
+*/
+func (d *Discovery) initZkSessionClient(addrs []string) error {
+
+	conn, _, err := zk.Connect(addrs, time.Second*5)
+	if err != nil {
+		return err
+	}
+	d.nativeClient = conn
+	return nil
+}
+
+/*
+ensureZkParentPath 递归确保key的上级目录链已存在
+复用d.store.Exists/Put(IsDir)，与WatchNodes为d.nspath建目录的方式一致，
+避免conn.Create在一个全新的d.nspath下因父节点不存在而报ErrNoNode
+*/
+func (d *Discovery) ensureZkParentPath(key string) error {
+
+	parent := path.Dir(key)
+	if parent == "" || parent == "." || parent == "/" {
+		return nil
+	}
+
+	exists, err := d.store.Exists(parent, nil)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	if err := d.ensureZkParentPath(parent); err != nil {
+		return err
+	}
+	return d.store.Put(parent, []byte(""), &store.WriteOptions{IsDir: true})
+}
+
+/*
+registerWithZkSession 针对ZK后端的临时节点(ephemeral)适配
+用d.nativeClient直接创建一个FlagEphemeral节点，节点的生命周期与当前zk会话绑定，
+会话断开节点自动消失，无需轮询心跳
+*/
+func (d *Discovery) registerWithZkSession(key string, buf []byte, stopCh <-chan struct{}) (<-chan error, bool) {
+
+	conn, ok := d.nativeClient.(*zk.Conn)
+	if !ok || conn == nil {
+		return nil, false
+	}
+
+	if err := d.ensureZkParentPath(key); err != nil {
+		log.Printf("discovery zk ensure parent path for(%s) error:%s\n", key, err.Error())
+		return nil, false
+	}
+
+	if _, err := conn.Create(key, buf, zk.FlagEphemeral, zk.WorldACL(zk.PermAll)); err != nil {
+		if err == zk.ErrNodeExists {
+			if _, stat, serr := conn.Get(key); serr == nil {
+				conn.Set(key, buf, stat.Version)
+			}
+		} else {
+			log.Printf("discovery zk create ephemeral node(%s) error:%s\n", key, err.Error())
+			return nil, false
+		}
+	}
+
+	errCh := make(chan error)
+	go func() {
+		defer close(errCh)
+		<-stopCh
+		conn.Delete(key, -1)
+	}()
+	return errCh, true
+}
@@ -0,0 +1,18 @@
+// +build !zk
+
+package kv
+
+/*
+本文件是zk原生ephemeral客户端在未启用zk build tag时的占位实现，
+避免kv.go/kv_session.go无条件引入github.com/samuel/go-zookeeper这一较重的依赖。
+initZkSessionClient直接返回nil(不报错，视为该增强能力未启用)，
+registerWithZkSession返回(nil, false)使RegisterWithSession自动回退到心跳Register
+*/
+
+func (d *Discovery) initZkSessionClient(addrs []string) error {
+	return nil
+}
+
+func (d *Discovery) registerWithZkSession(key string, buf []byte, stopCh <-chan struct{}) (<-chan error, bool) {
+	return nil, false
+}
@@ -0,0 +1,65 @@
+package kv
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/abronan/valkeyrie/store"
+)
+
+/*
+TestBoltdbRegister 验证BoltDB后端下Register能把节点数据正确写入存储
+BoltDB是内嵌KV，不支持Watch/WatchTree，因此这里直接轮询d.store确认写入，而不是走WatchNodes
+使用本地临时文件作为内嵌存储，避免依赖外部集群
+*/
+func TestBoltdbRegister(t *testing.T) {
+
+	dbfile, err := ioutil.TempFile("", "discovery-boltdb-*.db")
+	if err != nil {
+		t.Fatalf("create temp boltdb file error:%s", err.Error())
+	}
+	dbfile.Close()
+	defer os.Remove(dbfile.Name())
+
+	d := &Discovery{backend: store.BOLTDB}
+	configopts := map[string]string{
+		"kv.bucket":             "discovery",
+		"kv.persist_connection": "true",
+	}
+
+	if err := d.Initialize(dbfile.Name(), time.Millisecond*100, time.Second*5, configopts); err != nil {
+		t.Fatalf("initialize boltdb discovery error:%s", err.Error())
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	errCh := d.Register("node-1", []byte("node-1-data"), stopCh)
+
+	nodeKey := path.Join(d.nspath, "node-1")
+	deadline := time.After(time.Second * 5)
+	for {
+		select {
+		case err := <-errCh:
+			t.Fatalf("register error:%s", err.Error())
+		case <-deadline:
+			t.Fatalf("timeout waiting for node-1 to be written")
+		case <-time.After(time.Millisecond * 50):
+			pair, err := d.store.Get(nodeKey, nil)
+			if err != nil {
+				continue
+			}
+			entry, err := d.codec.Unmarshal(pair.Value)
+			if err != nil {
+				t.Fatalf("decode registered entry error:%s", err.Error())
+			}
+			if entry.Key != "node-1" {
+				t.Fatalf("expect entry key %q, got %q", "node-1", entry.Key)
+			}
+			return
+		}
+	}
+}
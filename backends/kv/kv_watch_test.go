@@ -0,0 +1,108 @@
+package kv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/abronan/valkeyrie/store"
+	"github.com/humpback/discovery/backends"
+)
+
+/*
+TestWatchOnceFlushesDebouncedEntries 验证watchOnce在watchDebounce窗口内合并同一key的多次pair更新，
+最终按去重后的最新值解码下推到discoveryCh，而不是每条原始pair各推一次
+*/
+func TestWatchOnceFlushesDebouncedEntries(t *testing.T) {
+
+	codec, err := backends.GetCodec("msgpack")
+	if err != nil {
+		t.Fatalf("get msgpack codec error:%s", err.Error())
+	}
+
+	d := &Discovery{
+		codec:         codec,
+		watchDebounce: time.Millisecond * 20,
+		metrics:       backends.NoopMetrics{},
+	}
+
+	buf, err := d.codec.Marshal(&backends.Entry{Key: "node-1", Data: []byte("v2")})
+	if err != nil {
+		t.Fatalf("marshal entry error:%s", err.Error())
+	}
+
+	stopCh := make(chan struct{})
+	watchCh := make(chan []*store.KVPair, 2)
+	discoveryCh := make(chan backends.Entries, 1)
+	errCh := make(chan error, 1)
+
+	//同一key先后推送两次pair，watchOnce应在debounce窗口内合并为一份，仅保留最新值
+	watchCh <- []*store.KVPair{{Key: "node-1", Value: []byte("stale")}}
+	watchCh <- []*store.KVPair{{Key: "node-1", Value: buf}}
+	close(watchCh)
+
+	done := make(chan bool, 1)
+	go func() {
+		done <- d.watchOnce(stopCh, watchCh, discoveryCh, errCh)
+	}()
+
+	select {
+	case entries := <-discoveryCh:
+		if len(entries) != 1 {
+			t.Fatalf("expect 1 debounced entry, got %d", len(entries))
+		}
+		if entries[0].Key != "node-1" || string(entries[0].Data) != "v2" {
+			t.Fatalf("expect node-1/v2, got %+v", entries[0])
+		}
+	case err := <-errCh:
+		t.Fatalf("unexpected error:%s", err.Error())
+	case <-time.After(time.Second):
+		t.Fatalf("timeout waiting for debounced entries")
+	}
+
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Fatalf("expect watchOnce to return true on watchCh close, got false")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout waiting for watchOnce to return")
+	}
+}
+
+/*
+TestWatchOnceStopsOnStopCh 验证stopCh关闭时watchOnce立即返回false，不等待watchCh
+*/
+func TestWatchOnceStopsOnStopCh(t *testing.T) {
+
+	codec, err := backends.GetCodec("msgpack")
+	if err != nil {
+		t.Fatalf("get msgpack codec error:%s", err.Error())
+	}
+
+	d := &Discovery{
+		codec:         codec,
+		watchDebounce: time.Millisecond * 20,
+		metrics:       backends.NoopMetrics{},
+	}
+
+	stopCh := make(chan struct{})
+	watchCh := make(chan []*store.KVPair)
+	discoveryCh := make(chan backends.Entries, 1)
+	errCh := make(chan error, 1)
+
+	close(stopCh)
+
+	done := make(chan bool, 1)
+	go func() {
+		done <- d.watchOnce(stopCh, watchCh, discoveryCh, errCh)
+	}()
+
+	select {
+	case ok := <-done:
+		if ok {
+			t.Fatalf("expect watchOnce to return false on stopCh close, got true")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout waiting for watchOnce to return")
+	}
+}
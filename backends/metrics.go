@@ -0,0 +1,21 @@
+package backends
+
+/*
+Metrics 发现服务的可观测性钩子
+实现通常是对Prometheus counter的简单包装，调用方通过kv.Discovery.SetMetrics设置，
+不设置时使用NoopMetrics，调用开销可忽略
+*/
+type Metrics interface {
+	IncWatchEvents()
+	IncWatchErrors()
+	IncRegisterFailures()
+}
+
+/*
+NoopMetrics Metrics的空实现，作为未配置Metrics时的默认值
+*/
+type NoopMetrics struct{}
+
+func (NoopMetrics) IncWatchEvents()      {}
+func (NoopMetrics) IncWatchErrors()      {}
+func (NoopMetrics) IncRegisterFailures() {}